@@ -0,0 +1,413 @@
+package watcher
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// RawEvent is a filesystem change reported by a Backend. The backend is
+// responsible for translating whatever notification mechanism it uses
+// into this package's EventMask vocabulary.
+type RawEvent struct {
+	Name string
+	Mask EventMask
+}
+
+// Backend is the interface a filesystem change notification mechanism
+// must implement to be used by a Watcher. FsnotifyBackend wraps the
+// inotify/kqueue-based fsnotify package; PollBackend stats registered
+// paths on an interval for filesystems where that isn't available.
+type Backend interface {
+	Add(path string) error
+	Remove(path string) error
+	Events() <-chan RawEvent
+	Errors() <-chan error
+	Close() error
+}
+
+// BackendKind selects which Backend implementation New uses.
+type BackendKind int
+
+const (
+	// BackendAuto uses FsnotifyBackend, falling back to PollBackend if
+	// creating the fsnotify watcher fails with "too many open files".
+	// A later failure to add a watch does not trigger the fallback.
+	BackendAuto BackendKind = iota
+	BackendFsnotify
+	BackendPoll
+)
+
+// DefaultPollInterval is used by PollBackend when Options.PollInterval
+// is zero.
+const DefaultPollInterval = time.Second
+
+func newBackend(opts *Options) (Backend, error) {
+	switch opts.Backend {
+	case BackendPoll:
+		return NewPollBackend(opts.PollInterval), nil
+	case BackendFsnotify:
+		return NewFsnotifyBackend()
+	default:
+		b, err := NewFsnotifyBackend()
+		if err != nil {
+			if isTooManyOpenFiles(err) {
+				if *Debug { log.Println("falling back to poll backend:", err) }
+				return NewPollBackend(opts.PollInterval), nil
+			}
+			return nil, err
+		}
+		return b, nil
+	}
+}
+
+// FsnotifyBackend implements Backend on top of the fsnotify package.
+type FsnotifyBackend struct {
+	watcher *fsnotify.Watcher
+	events  chan RawEvent
+	errors  chan error
+	quit    chan bool
+	done    chan bool
+}
+
+// NewFsnotifyBackend creates a Backend backed by fsnotify.
+func NewFsnotifyBackend() (*FsnotifyBackend, error) {
+	fsw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	b := &FsnotifyBackend{
+		watcher: fsw,
+		events:  make(chan RawEvent),
+		errors:  make(chan error),
+		quit:    make(chan bool),
+		done:    make(chan bool),
+	}
+	go b.run()
+	return b, nil
+}
+
+func (b *FsnotifyBackend) Add(path string) error    { return b.watcher.Add(path) }
+func (b *FsnotifyBackend) Remove(path string) error { return b.watcher.Remove(path) }
+func (b *FsnotifyBackend) Events() <-chan RawEvent  { return b.events }
+func (b *FsnotifyBackend) Errors() <-chan error     { return b.errors }
+
+func (b *FsnotifyBackend) Close() error {
+	close(b.quit)
+	<-b.done
+	return b.watcher.Close()
+}
+
+func (b *FsnotifyBackend) run() {
+	active := true
+	for active {
+		select {
+		case ev, ok := <-b.watcher.Events:
+			if !ok {
+				active = false
+				break
+			}
+			var mask EventMask
+			if ev.Has(fsnotify.Create) { mask |= EventCreate }
+			if ev.Has(fsnotify.Write) { mask |= EventWrite }
+			if ev.Has(fsnotify.Rename) { mask |= EventRename }
+			if ev.Has(fsnotify.Remove) { mask |= EventDelete }
+			if ev.Has(fsnotify.Chmod) { mask |= EventChmod }
+			if !b.sendEvent(RawEvent{Name: ev.Name, Mask: mask}) {
+				active = false
+			}
+		case err, ok := <-b.watcher.Errors:
+			if !ok {
+				active = false
+				break
+			}
+			if err == fsnotify.ErrEventOverflow {
+				// Resync point: the kernel dropped events, so any
+				// in-flight state about watched paths may be stale.
+				if !b.sendEvent(RawEvent{Mask: EventOverflow}) {
+					active = false
+				}
+			} else {
+				if !b.sendErr(err) {
+					active = false
+				}
+			}
+		case <-b.quit:
+			active = false
+		}
+	}
+	close(b.events)
+	close(b.errors)
+	b.done <- true
+}
+
+// sendEvent delivers ev on b.events, but abandons it if b.quit fires
+// first. Without this, Close could hang forever: it closes b.quit and
+// waits for run() to finish, but if run() is itself blocked sending an
+// event to a receiver that's already gone, it would never get back to
+// this select to notice the quit signal.
+func (b *FsnotifyBackend) sendEvent(ev RawEvent) bool {
+	select {
+	case b.events <- ev:
+		return true
+	case <-b.quit:
+		return false
+	}
+}
+
+// sendErr is sendEvent's counterpart for b.errors.
+func (b *FsnotifyBackend) sendErr(err error) bool {
+	select {
+	case b.errors <- err:
+		return true
+	case <-b.quit:
+		return false
+	}
+}
+
+// PollBackend implements Backend by periodically stat-ing every
+// registered path and diffing the result against the previous snapshot.
+// It works anywhere os.Stat does, including NFS and FUSE mounts and
+// systems where the inotify watch limit is exhausted. A registered path
+// that is a directory is polled by listing its immediate children, so
+// that Add(dir) yields per-child events the same way FsnotifyBackend
+// does; a registered path that is a file is polled directly.
+type PollBackend struct {
+	interval time.Duration
+	events   chan RawEvent
+	errors   chan error
+	quit     chan bool
+	done     chan bool
+
+	mu    sync.Mutex
+	paths map[string]os.FileInfo
+	dirs  map[string]map[string]os.FileInfo
+}
+
+// NewPollBackend creates a Backend that polls every interval. A
+// non-positive interval is replaced by DefaultPollInterval.
+func NewPollBackend(interval time.Duration) *PollBackend {
+	if interval <= 0 {
+		interval = DefaultPollInterval
+	}
+	b := &PollBackend{
+		interval: interval,
+		events:   make(chan RawEvent),
+		errors:   make(chan error),
+		quit:     make(chan bool),
+		done:     make(chan bool),
+		paths:    make(map[string]os.FileInfo),
+		dirs:     make(map[string]map[string]os.FileInfo),
+	}
+	go b.run()
+	return b
+}
+
+func (b *PollBackend) Add(path string) error {
+	fi, err := os.Stat(path)
+	if err == nil && fi.IsDir() {
+		entries, _ := readDirEntries(path)
+		b.mu.Lock()
+		b.dirs[path] = entries
+		b.mu.Unlock()
+		return nil
+	}
+	b.mu.Lock()
+	b.paths[path] = fi
+	b.mu.Unlock()
+	return nil
+}
+
+func (b *PollBackend) Remove(path string) error {
+	b.mu.Lock()
+	delete(b.paths, path)
+	delete(b.dirs, path)
+	b.mu.Unlock()
+	return nil
+}
+
+func (b *PollBackend) Events() <-chan RawEvent { return b.events }
+func (b *PollBackend) Errors() <-chan error    { return b.errors }
+
+func (b *PollBackend) Close() error {
+	close(b.quit)
+	<-b.done
+	return nil
+}
+
+func (b *PollBackend) run() {
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+	active := true
+	for active {
+		select {
+		case <-ticker.C:
+			if !b.poll() {
+				active = false
+			}
+		case <-b.quit:
+			active = false
+		}
+	}
+	close(b.events)
+	close(b.errors)
+	b.done <- true
+}
+
+// poll restats every registered file and re-lists every registered
+// directory, reporting any changes found. It returns false if b.quit
+// fires while it's still delivering events, so run() can stop promptly
+// instead of leaving it blocked on an abandoned send.
+func (b *PollBackend) poll() bool {
+	b.mu.Lock()
+	paths := make([]string, 0, len(b.paths))
+	for path := range b.paths {
+		paths = append(paths, path)
+	}
+	dirs := make([]string, 0, len(b.dirs))
+	for dir := range b.dirs {
+		dirs = append(dirs, dir)
+	}
+	b.mu.Unlock()
+
+	for _, path := range paths {
+		if !b.pollFile(path) {
+			return false
+		}
+	}
+	for _, dir := range dirs {
+		if !b.pollDir(dir) {
+			return false
+		}
+	}
+	return true
+}
+
+func (b *PollBackend) pollFile(path string) bool {
+	fi, err := os.Stat(path)
+	b.mu.Lock()
+	prev := b.paths[path]
+	b.mu.Unlock()
+	if err != nil {
+		if prev != nil {
+			if !b.sendEvent(RawEvent{Name: path, Mask: EventDelete}) {
+				return false
+			}
+			b.mu.Lock()
+			b.paths[path] = nil
+			b.mu.Unlock()
+		}
+		return true
+	}
+	switch {
+	case prev == nil:
+		if !b.sendEvent(RawEvent{Name: path, Mask: EventCreate}) {
+			return false
+		}
+	case fi.ModTime() != prev.ModTime() || fi.Size() != prev.Size():
+		if !b.sendEvent(RawEvent{Name: path, Mask: EventModify}) {
+			return false
+		}
+	case fi.Mode() != prev.Mode():
+		if !b.sendEvent(RawEvent{Name: path, Mask: EventAttrib}) {
+			return false
+		}
+	default:
+		return true
+	}
+	b.mu.Lock()
+	b.paths[path] = fi
+	b.mu.Unlock()
+	return true
+}
+
+// pollDir lists dir's immediate children and diffs them against the
+// snapshot taken at Add or the previous poll, reporting a Create for
+// each new entry, a Delete for each entry that disappeared, and a
+// Modify/Attrib for each changed entry -- mirroring the per-child events
+// FsnotifyBackend delivers for a watched directory.
+func (b *PollBackend) pollDir(dir string) bool {
+	entries, err := readDirEntries(dir)
+	if err != nil {
+		b.mu.Lock()
+		prev := b.dirs[dir]
+		delete(b.dirs, dir)
+		b.mu.Unlock()
+		for name := range prev {
+			if !b.sendEvent(RawEvent{Name: filepath.Join(dir, name), Mask: EventDelete}) {
+				return false
+			}
+		}
+		return true
+	}
+
+	b.mu.Lock()
+	prev := b.dirs[dir]
+	b.mu.Unlock()
+
+	for name, fi := range entries {
+		child := filepath.Join(dir, name)
+		prevfi, ok := prev[name]
+		switch {
+		case !ok:
+			if !b.sendEvent(RawEvent{Name: child, Mask: EventCreate}) {
+				return false
+			}
+		case fi.ModTime() != prevfi.ModTime() || fi.Size() != prevfi.Size():
+			if !b.sendEvent(RawEvent{Name: child, Mask: EventModify}) {
+				return false
+			}
+		case fi.Mode() != prevfi.Mode():
+			if !b.sendEvent(RawEvent{Name: child, Mask: EventAttrib}) {
+				return false
+			}
+		}
+	}
+	for name := range prev {
+		if _, ok := entries[name]; !ok {
+			if !b.sendEvent(RawEvent{Name: filepath.Join(dir, name), Mask: EventDelete}) {
+				return false
+			}
+		}
+	}
+
+	b.mu.Lock()
+	b.dirs[dir] = entries
+	b.mu.Unlock()
+	return true
+}
+
+// readDirEntries lists dir's immediate children, keyed by name.
+func readDirEntries(dir string) (map[string]os.FileInfo, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	entries := make(map[string]os.FileInfo, len(infos))
+	for _, fi := range infos {
+		entries[fi.Name()] = fi
+	}
+	return entries, nil
+}
+
+// sendEvent is FsnotifyBackend.sendEvent's counterpart for PollBackend:
+// it delivers ev but abandons it if b.quit fires first, so poll() never
+// blocks Close forever on a send nobody will receive.
+func (b *PollBackend) sendEvent(ev RawEvent) bool {
+	select {
+	case b.events <- ev:
+		return true
+	case <-b.quit:
+		return false
+	}
+}
+
+func isTooManyOpenFiles(err error) bool {
+	return strings.Contains(err.Error(), "too many open files")
+}
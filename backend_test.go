@@ -0,0 +1,39 @@
+package watcher
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestPollBackendDir verifies that PollBackend.Add on a directory
+// reports per-child events the same way FsnotifyBackend does, rather
+// than only restating the directory path itself.
+func TestPollBackendDir(t *testing.T) {
+	testdir := tempMkdir(t)
+	defer os.RemoveAll(testdir)
+
+	b := NewPollBackend(20 * time.Millisecond)
+	defer b.Close()
+	if err := b.Add(testdir); err != nil {
+		t.Fatalf("Add(%s): %s", testdir, err)
+	}
+
+	testfile := filepath.Join(testdir, "foo")
+	touch(testfile)
+
+	select {
+	case ev := <-b.Events():
+		if ev.Name != testfile {
+			t.Errorf("expected event for %s, got %s", testfile, ev.Name)
+		}
+		if ev.Mask&EventCreate == 0 {
+			t.Errorf("expected CREATE, got %s", ev.Mask)
+		}
+	case err := <-b.Errors():
+		t.Fatalf("unexpected error: %s", err)
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timed out waiting for event on %s", testfile)
+	}
+}
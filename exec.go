@@ -0,0 +1,182 @@
+package watcher
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+// ExecMode controls what happens when a new batch of changes settles
+// while a previous Exec invocation triggered by Options.Exec is still
+// running.
+type ExecMode int
+
+const (
+	// ExecQueue runs invocations one at a time, in the order their
+	// batches settled. This is the default.
+	ExecQueue ExecMode = iota
+	// ExecLatest keeps at most one pending invocation: a batch that
+	// settles while the command is running replaces any batch still
+	// waiting to run.
+	ExecLatest
+	// ExecParallel spawns a new invocation for every settled batch,
+	// regardless of whether earlier ones are still running.
+	ExecParallel
+)
+
+// execQueueCapacity bounds how many pending invocations ExecQueue will
+// buffer before a settled batch blocks waiting for room.
+const execQueueCapacity = 64
+
+type execBatch struct {
+	files []Filename
+	mask  EventMask
+}
+
+// execBatches taps a stream of Events that carry Settled markers (as
+// produced by group()), running opts.Exec on each quiescent batch, and
+// passes every event through unchanged.
+func execBatches(events chan Event, opts *Options) chan Event {
+	out := make(chan Event)
+	go func() {
+		runner := newExecRunner(opts)
+		var batch execBatch
+		for event := range events {
+			batch.files = append(batch.files, event.Filename)
+			batch.mask |= event.Mask
+			if event.Settled {
+				runner.run(batch)
+				batch = execBatch{}
+			}
+			out <- event
+		}
+		runner.wait()
+		close(out)
+	}()
+	return out
+}
+
+// execRunner runs Options.Exec against settled batches, according to
+// Options.ExecMode.
+type execRunner struct {
+	opts *Options
+	tmpl *template.Template
+	work chan execBatch
+	wg   sync.WaitGroup
+}
+
+func newExecRunner(opts *Options) *execRunner {
+	r := &execRunner{
+		opts: opts,
+		tmpl: template.Must(template.New("exec").Parse(opts.Exec)),
+	}
+	if opts.ExecMode != ExecParallel {
+		capacity := execQueueCapacity
+		if opts.ExecMode == ExecLatest {
+			capacity = 1
+		}
+		r.work = make(chan execBatch, capacity)
+		r.wg.Add(1)
+		go r.worker()
+	}
+	return r
+}
+
+func (r *execRunner) worker() {
+	defer r.wg.Done()
+	for batch := range r.work {
+		r.exec(batch)
+	}
+}
+
+// run submits batch for execution according to opts.ExecMode.
+func (r *execRunner) run(batch execBatch) {
+	if len(batch.files) == 0 {
+		return
+	}
+	switch r.opts.ExecMode {
+	case ExecParallel:
+		r.wg.Add(1)
+		go func() {
+			defer r.wg.Done()
+			r.exec(batch)
+		}()
+	case ExecLatest:
+		select {
+		case r.work <- batch:
+		default:
+			select {
+			case <-r.work:
+			default:
+			}
+			select {
+			case r.work <- batch:
+			default:
+			}
+		}
+	default: // ExecQueue
+		r.work <- batch
+	}
+}
+
+func (r *execRunner) wait() {
+	if r.work != nil {
+		close(r.work)
+	}
+	r.wg.Wait()
+}
+
+// exec renders opts.Exec against batch and runs the result, either as a
+// shell command line (opts.ExecShell) or as argv split on whitespace.
+func (r *execRunner) exec(batch execBatch) {
+	files := make([]string, len(batch.files))
+	for i, f := range batch.files {
+		files[i] = string(f)
+	}
+	last := files[len(files)-1]
+	data := struct {
+		Files string
+		File  string
+		Dir   string
+		Event string
+	}{
+		// Files is pre-joined with spaces, like $WATCHER_FILES below, so
+		// {{.Files}} is directly usable in a command line rather than
+		// rendering as Go's "[a b]" slice syntax.
+		Files: strings.Join(files, " "),
+		File:  last,
+		Dir:   filepath.Dir(last),
+		Event: batch.mask.String(),
+	}
+
+	var buf bytes.Buffer
+	if err := r.tmpl.Execute(&buf, data); err != nil {
+		log.Printf("Error: exec template: %s", err)
+		return
+	}
+	commandLine := buf.String()
+
+	var cmd *exec.Cmd
+	if r.opts.ExecShell {
+		cmd = exec.Command("sh", "-c", commandLine)
+	} else {
+		fields := strings.Fields(commandLine)
+		if len(fields) == 0 {
+			return
+		}
+		cmd = exec.Command(fields[0], fields[1:]...)
+	}
+	cmd.Env = append(os.Environ(), "WATCHER_FILES="+strings.Join(files, " "))
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	if *Debug { log.Printf("exec: %s", commandLine) }
+	if err := cmd.Run(); err != nil {
+		log.Printf("Error: exec %q: %s", commandLine, err)
+	}
+}
@@ -0,0 +1,93 @@
+package watcher
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// maxHashEntries bounds the memory used by a hashCache; the least
+// recently used entry is evicted once the cache grows past this size.
+const maxHashEntries = 1024
+
+// hashCache remembers the content hash last emitted for each filename,
+// so that Options.HashSuppress can drop events that leave a file's
+// contents unchanged. It is an LRU of bounded size.
+type hashCache struct {
+	capacity int
+
+	mu    sync.Mutex
+	ll    *list.List
+	items map[Filename]*list.Element
+}
+
+type hashEntry struct {
+	filename Filename
+	sum      []byte
+}
+
+func newHashCache(capacity int) *hashCache {
+	return &hashCache{
+		capacity: capacity,
+		ll:       list.New(),
+		items:    make(map[Filename]*list.Element),
+	}
+}
+
+func (c *hashCache) get(filename Filename) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[filename]
+	if !ok {
+		return nil, false
+	}
+	c.ll.MoveToFront(el)
+	return el.Value.(*hashEntry).sum, true
+}
+
+func (c *hashCache) set(filename Filename, sum []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[filename]; ok {
+		el.Value.(*hashEntry).sum = sum
+		c.ll.MoveToFront(el)
+		return
+	}
+	el := c.ll.PushFront(&hashEntry{filename: filename, sum: sum})
+	c.items[filename] = el
+	if c.ll.Len() > c.capacity {
+		oldest := c.ll.Back()
+		if oldest != nil {
+			c.ll.Remove(oldest)
+			delete(c.items, oldest.Value.(*hashEntry).filename)
+		}
+	}
+}
+
+func (c *hashCache) evict(filename Filename) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[filename]; ok {
+		c.ll.Remove(el)
+		delete(c.items, filename)
+	}
+}
+
+// hashFile reads filename and returns a sha256 digest of its contents.
+// It returns ok=false if the file can't be read, e.g. because it was
+// removed before the hash could be taken, or if it's a named pipe --
+// reading one would block indefinitely waiting for a writer.
+func hashFile(filename Filename) (sum []byte, ok bool) {
+	fi, err := os.Lstat(string(filename))
+	if err != nil || fi.Mode()&os.ModeNamedPipe != 0 {
+		return nil, false
+	}
+	data, err := ioutil.ReadFile(string(filename))
+	if err != nil {
+		return nil, false
+	}
+	digest := sha256.Sum256(data)
+	return digest[:], true
+}
@@ -10,17 +10,26 @@
 package watcher
 
 import (
+	"bytes"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
-	"code.google.com/p/go.exp/fsnotify"
 	"os"
+	"path/filepath"
 	"regexp"
 	"strings"
+	"sync"
 	"time"
 )
 
+// ErrRecursionUnsupported is returned when recursive watching is
+// requested but the underlying backend has no way to enumerate or watch
+// an entire directory tree.
+var ErrRecursionUnsupported = errors.New("watcher: backend does not support recursive watching")
+
 type EventMask uint32
 func (mask EventMask) String() string {
 	var strs []string
@@ -39,15 +48,27 @@ func (mask EventMask) String() string {
 	if mask & EventAttrib == EventAttrib {
 		strs = append(strs, "ATTRIB")
 	}
+	if mask & EventOverflow == EventOverflow {
+		strs = append(strs, "OVERFLOW")
+	}
 	return strings.Join(strs, "|")
 }
 
 const (
 	EventCreate  EventMask = 1 << iota
-	EventModify
+	EventWrite
 	EventRename
 	EventDelete
-	EventAttrib
+	EventChmod
+	EventOverflow
+)
+
+// EventModify and EventAttrib are retained as aliases for EventWrite and
+// EventChmod, the names used before the migration to fsnotify v1's Op
+// vocabulary.
+const (
+	EventModify = EventWrite
+	EventAttrib = EventChmod
 )
 
 type Event struct {
@@ -74,6 +95,36 @@ type Options struct {
 	Subdirs bool
 	Longform bool
 	Group bool
+
+	// Backend selects the change-notification mechanism. The zero value,
+	// BackendAuto, uses fsnotify and falls back to polling if creating
+	// the fsnotify watcher fails with "too many open files".
+	Backend BackendKind
+
+	// PollInterval is how often BackendPoll restats watched paths. Zero
+	// means DefaultPollInterval.
+	PollInterval time.Duration
+
+	// HashSuppress drops an event, once its latency period expires, if
+	// the file's content hash matches the hash recorded for that path
+	// after the last emitted event. This filters out the no-op
+	// Create+Write bursts produced by editors that write-and-rename.
+	HashSuppress bool
+
+	// Exec, if non-empty, is run whenever a quiescent batch of changes
+	// settles. It is a text/template string with {{.Files}}, {{.File}},
+	// {{.Dir}}, and {{.Event}} placeholders; the batch's filenames are
+	// also available as $WATCHER_FILES in the command's environment.
+	Exec string
+
+	// ExecShell runs Exec through "sh -c" instead of splitting it into
+	// argv on whitespace.
+	ExecShell bool
+
+	// ExecMode controls what happens when a new batch settles while a
+	// previous Exec invocation is still running. The zero value,
+	// ExecQueue, runs invocations one at a time in order.
+	ExecMode ExecMode
 }
 
 
@@ -90,14 +141,292 @@ func isdir(filename string) bool {
 	return fi.IsDir()
 }
 
+// Watcher is the programmatic, streaming entry point for the package. It
+// mirrors the shape of fsnotify.Watcher: callers read Event values off
+// Events and errors off Errors until Close is called, and add or remove
+// watched paths with Add/Remove. Add/Remove are safe to call from any
+// goroutine, including concurrently with each other and with a running
+// recursive-watch cycle.
+type Watcher struct {
+	Events chan Event
+	Errors chan error
+
+	backend Backend
+	opts    *Options
+	quit    chan bool
+	done    chan bool
+
+	watchesMu sync.Mutex
+	watches   map[string]bool
+}
+
+// New creates a Watcher that watches the given directories, using the
+// Backend selected by opts.Backend. If opts.Subdirs is set, each
+// directory is walked recursively at startup and a watch is added for
+// every nested directory found. Events and errors are available on the
+// Events and Errors channels respectively, both of which are closed once
+// Close returns.
+//
+// A directory that can't be watched is logged and skipped rather than
+// aborting the whole set, matching the behavior of the original
+// directory-walking code in cmd/watcher.
+func New(directories []string, opts *Options) (*Watcher, error) {
+	backend, err := newBackend(opts)
+	if err != nil {
+		return nil, err
+	}
+	w := &Watcher{
+		Events:  make(chan Event),
+		Errors:  make(chan error),
+		backend: backend,
+		opts:    opts,
+		quit:    make(chan bool),
+		done:    make(chan bool),
+		watches: make(map[string]bool),
+	}
+	for _, directory := range directories {
+		var err error
+		if opts.Subdirs {
+			err = w.addTree(directory)
+		} else {
+			err = w.Add(directory)
+		}
+		if err != nil {
+			log.Printf("Error: watcher.Add(%s): %s", directory, err)
+		}
+	}
+	go w.run()
+	return w, nil
+}
+
+// Add starts watching path.
+func (w *Watcher) Add(path string) error {
+	if *Debug { log.Printf("Watching %v", path) }
+	if err := w.backend.Add(path); err != nil {
+		return err
+	}
+	w.watchesMu.Lock()
+	w.watches[path] = true
+	w.watchesMu.Unlock()
+	return nil
+}
+
+// Remove stops watching path.
+func (w *Watcher) Remove(path string) error {
+	w.watchesMu.Lock()
+	delete(w.watches, path)
+	w.watchesMu.Unlock()
+	return w.backend.Remove(path)
+}
+
+// hasWatch reports whether path is currently being watched.
+func (w *Watcher) hasWatch(path string) bool {
+	w.watchesMu.Lock()
+	defer w.watchesMu.Unlock()
+	return w.watches[path]
+}
+
+// dirContainsNamedPipe reports whether dir has an immediate child that is
+// a named pipe. Watching such a directory risks a reader -- in
+// particular Options.HashSuppress, which reads a settled file's full
+// contents -- blocking forever on a pipe with no writer, so these
+// directories are skipped, matching the original -subdirs walk's
+// badfiles handling.
+func dirContainsNamedPipe(dir string) bool {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return false
+	}
+	for _, entry := range entries {
+		if entry.Mode()&os.ModeNamedPipe != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// addTree walks root, honoring opts.Exclude, and adds a watch for every
+// directory found, including root itself. A directory that contains a
+// named pipe is not watched, and neither is anything beneath it.
+func (w *Watcher) addTree(root string) error {
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		if w.opts.Exclude != nil && w.opts.Exclude.MatchString(path) {
+			if *Debug { log.Printf("Excluding %s", path) }
+			return filepath.SkipDir
+		}
+		if dirContainsNamedPipe(path) {
+			log.Printf("Warning: %s contains a named pipe; not watching it", path)
+			return filepath.SkipDir
+		}
+		return w.Add(path)
+	})
+}
+
+// addTreeLive walks a newly created directory root, watching every
+// nested directory it finds and synthesizing a Create event for every
+// entry discovered. This covers the race where files or subdirectories
+// are created under root before its watch is registered. Paths matching
+// opts.Exclude, and directories that contain a named pipe, are skipped
+// along with everything beneath them.
+func (w *Watcher) addTreeLive(root string) []Event {
+	var events []Event
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if w.opts.Exclude != nil && w.opts.Exclude.MatchString(path) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() {
+			if dirContainsNamedPipe(path) {
+				log.Printf("Warning: %s contains a named pipe; not watching it", path)
+				return filepath.SkipDir
+			}
+			if err := w.Add(path); err != nil {
+				log.Printf("Error: watcher.Add(%s): %s", path, err)
+			}
+		}
+		if path == root {
+			return nil // root's own Create event was already reported by the caller
+		}
+		events = append(events, Event{
+			Filename:  Filename(path),
+			Timestamp: time.Now(),
+			Mask:      EventCreate,
+			Fileinfo:  info,
+		})
+		return nil
+	})
+	if err != nil {
+		log.Printf("Error: addTreeLive(%s): %s", root, err)
+	}
+	return events
+}
+
+// removeTree removes the watch on root and on every descendant watch
+// recorded in w.watches, as tracked from a prior addTree/addTreeLive.
+func (w *Watcher) removeTree(root string) {
+	prefix := root + string(os.PathSeparator)
+	w.watchesMu.Lock()
+	var stale []string
+	for watched := range w.watches {
+		if watched == root || strings.HasPrefix(watched, prefix) {
+			stale = append(stale, watched)
+		}
+	}
+	w.watchesMu.Unlock()
+	for _, watched := range stale {
+		w.Remove(watched)
+	}
+}
+
+// Close stops the watcher, closes Events and Errors, and releases the
+// underlying backend's resources.
+func (w *Watcher) Close() error {
+	close(w.quit)
+	<-w.done
+	return w.backend.Close()
+}
+
+// run reads from the backend, translating its RawEvents into Event
+// values on w.Events, until Close is called.
+func (w *Watcher) run() {
+	opts := w.opts
+	active := true
+	for active {
+		select {
+		case raw, ok := <-w.backend.Events():
+			if ! ok {
+				log.Panic("backend Events channel closed unexpectedly")
+			}
+			var event Event
+			event.Timestamp = time.Now() // record event time ASAP
+
+			if raw.Mask&EventOverflow != 0 {
+				event.Mask = EventOverflow
+				w.Events <- event
+				break
+			}
+
+			if *Debug { log.Println("from backend:", raw) }
+			if opts.Exclude != nil && opts.Exclude.MatchString(raw.Name) {
+				if *Debug { log.Println("Excluding:", raw.Name) }
+				break
+			}
+			var synthetic []Event
+			if opts.Subdirs && raw.Mask&EventCreate != 0 && isdir(raw.Name) {
+				synthetic = w.addTreeLive(raw.Name)
+			}
+			if opts.Subdirs && raw.Mask&(EventDelete|EventRename) != 0 && w.hasWatch(raw.Name) {
+				w.removeTree(raw.Name)
+			}
+			event.Filename = Filename(raw.Name)
+			event.Mask = raw.Mask
+			var err error
+			event.Fileinfo, err = os.Stat(raw.Name)
+			if err != nil {
+				if strings.Contains(err.Error(), "no such file or directory") {
+					if *Debug {
+						log.Print(err)
+					}
+					// ignore this error if not debugging
+				} else {
+					log.Print(err)
+				}
+			}
+			w.Events <- event
+			for _, se := range synthetic {
+				w.Events <- se
+			}
+		case err := <-w.backend.Errors():
+			w.Errors <- err
+		case <-w.quit:
+			active = false
+		}
+	}
+	if *Debug { log.Println("watch() closing") }
+	close(w.Events)
+	close(w.Errors)
+	w.done <- true
+}
+
 // Watchdirs() is the main entry point for watching a list of directories.
+// It is a CLI-oriented wrapper around the Watcher streaming API that
+// formats events and writes them to out.
 func Watchdirs(directories []string, opts *Options, quit chan bool, out io.Writer) {
-	events := watch(directories, opts, quit)
+	w, err := New(directories, opts)
+	if err != nil {
+		log.Panic(err)
+	}
+	go func() {
+		<-quit
+		w.Close()
+	}()
+	go func() {
+		for err := range w.Errors {
+			log.Println("Error: watcher.Error", err)
+		}
+	}()
+	events := w.Events
 	if opts.Latency != 0 {
 		events = simplify(events, opts)
 	}
-	if opts.Group {
+	if opts.Group || opts.Exec != "" {
 		events = group(events, opts)
+	}
+	if opts.Exec != "" {
+		events = execBatches(events, opts)
+	}
+	if opts.Group {
 		for event := range events {
 			fmt.Fprint(out, event.Filename)
 			if event.Settled {
@@ -130,12 +459,16 @@ func Watchdirs(directories []string, opts *Options, quit chan bool, out io.Write
 func simplify(events chan Event, opts *Options) chan Event {
 	out := make(chan Event)
 	done := make(chan bool)
+	var cache *hashCache
+	if opts.HashSuppress {
+		cache = newHashCache(maxHashEntries)
+	}
 	go func() {
 		handlers := make(map[Filename]chan<-Event)
 		for event := range events {
 			handler, ok := handlers[event.Filename]
 			if ! ok {
-				handler = make_handler(event.Filename, opts.Latency, out, done)
+				handler = make_handler(event.Filename, opts, cache, out, done)
 				handlers[event.Filename] = handler
 			}
 			handler <- event
@@ -151,14 +484,16 @@ func simplify(events chan Event, opts *Options) chan Event {
 
 // make_handler reads a channel of events for a single filename and
 // writes an event to its output channel only after a latency period
-// expires with no further events.
-func make_handler(filename Filename, latency time.Duration, out chan Event, done chan bool) chan<- Event {
+// expires with no further events. If cache is non-nil (opts.HashSuppress
+// is set), an event is dropped when the file's content hash matches the
+// hash recorded there after the last emitted event.
+func make_handler(filename Filename, opts *Options, cache *hashCache, out chan Event, done chan bool) chan<- Event {
 	if *Debug { log.Printf("make_handler(%v)", filename) }
 	input := make(chan Event)
 	go func() {
 		var event Event
 		var ok bool
-		timer := time.NewTimer(latency)
+		timer := time.NewTimer(opts.Latency)
 		for {
 			select {
 			case event, ok = <-input:
@@ -166,13 +501,24 @@ func make_handler(filename Filename, latency time.Duration, out chan Event, done
 					done <- true
 					return
 				}
-				timer.Reset(latency)
+				timer.Reset(opts.Latency)
 			case <- timer.C:
+				if cache != nil {
+					if event.Mask&EventDelete != 0 {
+						cache.evict(filename)
+					} else if sum, ok := hashFile(filename); ok {
+						if prev, seen := cache.get(filename); seen && bytes.Equal(prev, sum) {
+							if *Debug { log.Printf("suppressing no-op write: %v", filename) }
+							continue
+						}
+						cache.set(filename, sum)
+					}
+				}
 				out <- event
 			}
 		}
 	}()
-	return input	
+	return input
 }
 
 // group modifies a channel of Events, effectively grouping them by
@@ -210,75 +556,3 @@ func group(events chan Event, opts *Options) chan Event {
 	return out
 }
 
-// watch returns a channel that produces Event items reporting file
-// changes within the given directories. It wraps an fsnotify watcher
-// so as to ignore events on filenames that match an pattern, to add
-// a timestamp to the event data, to establish new watches as
-// subdirectories are created, and to add fileinfo information.
-func watch(directories []string, opts *Options, quit chan bool) chan Event {
-	watcher, err := fsnotify.NewWatcher()
-	if err != nil {
-		log.Panic(err)
-	}
-	for _, directory := range directories {
-		if *Debug { log.Printf("Watching %v", directory) }
-		err = watcher.Watch(directory)
-		if err != nil {
-			log.Printf("Error: watcher.Watch(%s): %s\n", directory, err)
-			if strings.Contains(err.Error(), "too many open files") {
-				log.Panic("quitting")
-			}
-		}
-	}
-	if *Debug { log.Println("All directory watches established") }
-	events := make(chan Event)
-	go func() {
-		active := true
-		for active {
-			select {
-			case ev, ok := <-watcher.Event:
-				if ! ok {
-					log.Panic("watcher.Event channel closed unexpectedly")
-				}
-				var event Event
-				event.Timestamp = time.Now() // record event time ASAP
-
-				if *Debug { log.Println("from watcher.Event:", ev) }
-				if opts.Exclude != nil && opts.Exclude.MatchString(ev.Name) {
-					if *Debug { log.Println("Excluding:", ev.Name) }
-					break
-				}
-				if opts.Subdirs && ev.IsCreate() && isdir(ev.Name) {
-					watcher.Watch(ev.Name)
-					if *Debug { log.Printf("Adding watch of %v", ev.Name) }
-				}
-				event.Filename = Filename(ev.Name)
-				if ev.IsCreate() { event.Mask |= EventCreate } 
-				if ev.IsModify() { event.Mask |= EventModify } 
-				if ev.IsRename() { event.Mask |= EventRename } 
-				if ev.IsDelete() { event.Mask |= EventDelete } 
-				if ev.IsAttrib() { event.Mask |= EventAttrib } 
-				event.Fileinfo, err = os.Stat(ev.Name)
-				if err != nil {
-					if strings.Contains(err.Error(), "no such file or directory") {
-						if *Debug {
-							log.Print(err)
-						}
-						// ignore this error if not debugging
-					} else {
-						log.Print(err)
-					}
-				}
-				events <- event
-			case err := <-watcher.Error:
-				log.Println("Error: watcher.Error", err)
-			case <-quit:
-				active = false
-			}
-		}
-		if *Debug { log.Println("watch() closing") }
-		watcher.Close()
-		close(events)
-	}()
-	return events
-}
@@ -3,13 +3,11 @@
 package main
 
 import (
-	"path/filepath"
 	"flag"
 	"github.com/fredcy/watcher"
 	"log"
 	"os"
 	"regexp"
-	"strings"
 	"time"
 )
 
@@ -20,6 +18,8 @@ func main() {
 	var subdirflag = flag.Bool("subdirs", false, "watch subdirectories too")
 	var longflag = flag.Bool("long", false, "long format outout")
 	var groupflag = flag.Bool("group", false, "group files changed before latency period")
+	var execflag = flag.String("exec", "", "command to run on each settled batch of changes; supports {{.Files}}/{{.File}}/{{.Dir}}/{{.Event}} placeholders")
+	var execmodeflag = flag.String("exec-mode", "queue", "how to handle a new batch while -exec is still running: queue, latest, or parallel")
 
 	flag.Parse()
 	if *nostamp {
@@ -32,53 +32,26 @@ func main() {
 	if *excludeflag != "" {
 		exclude = regexp.MustCompile(*excludeflag)
 	}
-	var dirstowatch []string
-	if *subdirflag {
-		subdirs := make([]string, 0)
-		badfiles := make(map[string]bool)
-		walkfn := func(path string, info os.FileInfo, err error) error {
-			//log.Printf("walkfn(%v, %v, %v)", path, info, err)
-			switch {
-			case err != nil:
-				log.Printf("warning: %v", err)
-				switch {
-				case strings.Contains(err.Error(), "no such file or directory"):
-					// handle first since info.IsDir() cannot work in this case
-					badfiles[path] = true
-				case info.IsDir():
-					// directories sometimes get visited twice (oddly)
-					// with an error on the second visit only
-					badfiles[path] = true
-					return filepath.SkipDir
-				}
-			case info.IsDir():
-				if exclude != nil && exclude.MatchString(path) {
-					if *watcher.Debug { log.Printf("Excluding %s", path) }
-					return filepath.SkipDir
-				}
-				subdirs = append(subdirs, path)
-			case info.Mode() & os.ModeNamedPipe == os.ModeNamedPipe:
-				dirpath := filepath.Dir(path)
-				log.Printf("Warning: %s is a named pipe; ignoring %s",
-					path, dirpath)
-				badfiles[dirpath] = true
-			}
-			return nil
-		}
-		for _, directory := range(directories) {
-			filepath.Walk(directory, walkfn)
-		}
-		// filter the generated list of directories, removing any marked as bad above
-		for _, dir := range(subdirs) {
-			if ! badfiles[dir] {
-				dirstowatch = append(dirstowatch, dir)
-			}
-		}
-	} else {
-		dirstowatch = directories
+	var execmode watcher.ExecMode
+	switch *execmodeflag {
+	case "queue":
+		execmode = watcher.ExecQueue
+	case "latest":
+		execmode = watcher.ExecLatest
+	case "parallel":
+		execmode = watcher.ExecParallel
+	default:
+		log.Fatalf("invalid -exec-mode %q: must be queue, latest, or parallel", *execmodeflag)
 	}
-
 	done := make(chan bool)
-	opts := watcher.Options{*latency, exclude, *subdirflag, *longflag, *groupflag}
-	watcher.Watchdirs(dirstowatch, &opts, done, os.Stdout)
+	opts := watcher.Options{
+		Latency:  *latency,
+		Exclude:  exclude,
+		Subdirs:  *subdirflag,
+		Longform: *longflag,
+		Group:    *groupflag,
+		Exec:     *execflag,
+		ExecMode: execmode,
+	}
+	watcher.Watchdirs(directories, &opts, done, os.Stdout)
 }
@@ -2,12 +2,15 @@ package watcher
 
 import (
 	"bytes"
+	"fmt"
 	"path/filepath"
 	"io/ioutil"
 	"log"
 	"os"
 	"regexp"
 	"runtime"
+	"strings"
+	"syscall"
 	"testing"
 	"time"
 )
@@ -110,6 +113,54 @@ func TestWatchdirs(t *testing.T) {
 	must_equal(t, foo + "\t" + bar + "\n" + blah + "\n", out.String())
 }
 
+// TestCloseDoesNotHang stresses Watcher.Close() against a stream of
+// concurrent file writes, repeatedly racing Close() against in-flight
+// backend events. Before the backend learned to abandon a blocked send
+// once it's told to quit, this could deadlock: Close() closes the
+// watcher's own quit channel and waits for run() to exit, but run() can
+// exit having picked that case over a backend event that's mid-send, so
+// backend.Close() then waits forever for a goroutine that can never get
+// back to its select to notice it.
+func TestCloseDoesNotHang(t *testing.T) {
+	testdir := tempMkdir(t)
+	defer os.RemoveAll(testdir)
+	dirs := []string{testdir}
+
+	for i := 0; i < 5; i++ {
+		var opts Options
+		quit := make(chan bool)
+		done := make(chan bool)
+		var out bytes.Buffer
+		go func() {
+			Watchdirs(dirs, &opts, quit, &out)
+			done <- true
+		}()
+
+		stop := make(chan bool)
+		stopped := make(chan bool)
+		go func(iteration int) {
+			for j := 0; ; j++ {
+				select {
+				case <-stop:
+					stopped <- true
+					return
+				default:
+					touch(filepath.Join(testdir, fmt.Sprintf("f%d-%d", iteration, j)))
+				}
+			}
+		}(i)
+
+		quit <- true
+		select {
+		case <-done:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Watchdirs did not return after Close (iteration %d): backend deadlocked on an in-flight send", i)
+		}
+		close(stop)
+		<-stopped
+	}
+}
+
 func TestSubdirs(t *testing.T) {
 	testdir := tempMkdir(t)
 	defer os.RemoveAll(testdir)
@@ -146,3 +197,178 @@ func TestSubdirs(t *testing.T) {
 		must_equal(t, subdir + "\t" + subfile1 + "\n" + subfile2 + "\n", out.String())
 	}
 }
+
+// TestSubdirsNested verifies that a directory created after startup is
+// itself watched, not just walked, so that a directory created inside it
+// is in turn watched too. This covers recursion past the first new level,
+// which the straightforward "walk but don't watch root" mistake breaks.
+func TestSubdirsNested(t *testing.T) {
+	testdir := tempMkdir(t)
+	defer os.RemoveAll(testdir)
+	dirs := []string{testdir}
+	var opts Options
+	opts.Latency = 200 * time.Millisecond
+	opts.Subdirs = true
+	opts.Group = true
+	quit := make(chan bool)
+	done := make(chan bool)
+	var out bytes.Buffer
+	go func() {
+		Watchdirs(dirs, &opts, quit, &out)
+		done <- true
+	}()
+
+	subdir := filepath.Join(testdir, "subdir")
+	subsubdir := filepath.Join(subdir, "subsubdir")
+	deepfile := filepath.Join(subsubdir, "deep")
+	time.Sleep(100 * time.Millisecond) // allow Watchdirs to set up
+	mkdir(subdir)
+	time.Sleep(opts.Latency / 2) // enough time for subdir watch to establish, but less than latency
+	mkdir(subsubdir)
+	time.Sleep(3 * opts.Latency) // enough time for subsubdir watch to establish
+	touch(deepfile)
+	time.Sleep(3 * opts.Latency) // enough time for latency to expire
+	quit <- true
+	<-done
+
+	if !strings.Contains(out.String(), deepfile) {
+		t.Errorf("expected output to report %s (two levels of subdirs created after startup), got %q", deepfile, out.String())
+	}
+}
+
+// TestHashSuppress verifies that rewriting a file with the same content it
+// already had suppresses the event once the latency period expires, while
+// a write that actually changes the content is still reported.
+func TestHashSuppress(t *testing.T) {
+	testdir := tempMkdir(t)
+	defer os.RemoveAll(testdir)
+	dirs := []string{testdir}
+	var opts Options
+	opts.Latency = 200 * time.Millisecond
+	opts.HashSuppress = true
+	quit := make(chan bool)
+	done := make(chan bool)
+	var out bytes.Buffer
+	go func() {
+		Watchdirs(dirs, &opts, quit, &out)
+		done <- true
+	}()
+
+	time.Sleep(100 * time.Millisecond) // allow Watchdirs to set up
+	testfile := filepath.Join(testdir, "foo")
+	if err := ioutil.WriteFile(testfile, []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(3 * opts.Latency) // allow latency to expire
+
+	// Same content: should be suppressed.
+	if err := ioutil.WriteFile(testfile, []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(3 * opts.Latency)
+
+	// Different content: should be reported.
+	if err := ioutil.WriteFile(testfile, []byte("goodbye"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(3 * opts.Latency)
+	quit <- true
+	<-done
+
+	must_equal(t, testfile+"\n"+testfile+"\n", out.String())
+}
+
+// TestExec verifies that Options.Exec runs once a batch of changes
+// settles.
+func TestExec(t *testing.T) {
+	testdir := tempMkdir(t)
+	defer os.RemoveAll(testdir)
+	dirs := []string{testdir}
+	marker := filepath.Join(testdir, "marker")
+	var opts Options
+	opts.Latency = 200 * time.Millisecond
+	opts.Exec = "touch " + marker
+	quit := make(chan bool)
+	done := make(chan bool)
+	var out bytes.Buffer
+	go func() {
+		Watchdirs(dirs, &opts, quit, &out)
+		done <- true
+	}()
+
+	time.Sleep(100 * time.Millisecond) // allow Watchdirs to set up
+	touch(filepath.Join(testdir, "foo"))
+	time.Sleep(3 * opts.Latency) // allow latency to expire and Exec to run
+	quit <- true
+	<-done
+
+	if _, err := os.Stat(marker); err != nil {
+		t.Errorf("expected Exec to have created %s, got: %s", marker, err)
+	}
+}
+
+// TestExecFiles verifies that the {{.Files}} placeholder renders as a
+// plain space-separated list usable in a command line, not Go's "[a b]"
+// slice syntax.
+func TestExecFiles(t *testing.T) {
+	testdir := tempMkdir(t)
+	defer os.RemoveAll(testdir)
+	dirs := []string{testdir}
+	marker := filepath.Join(testdir, "marker")
+	var opts Options
+	opts.Latency = 200 * time.Millisecond
+	opts.ExecShell = true
+	opts.Exec = "echo {{.Files}} > " + marker
+	quit := make(chan bool)
+	done := make(chan bool)
+	var out bytes.Buffer
+	go func() {
+		Watchdirs(dirs, &opts, quit, &out)
+		done <- true
+	}()
+
+	time.Sleep(100 * time.Millisecond) // allow Watchdirs to set up
+	testfile := filepath.Join(testdir, "foo")
+	touch(testfile)
+	time.Sleep(3 * opts.Latency) // allow latency to expire and Exec to run
+	quit <- true
+	<-done
+
+	content, err := ioutil.ReadFile(marker)
+	if err != nil {
+		t.Fatalf("expected Exec to have created %s: %s", marker, err)
+	}
+	must_equal(t, testfile+"\n", string(content))
+}
+
+// TestHashFileNamedPipe verifies that hashFile refuses to read a named
+// pipe instead of blocking forever waiting for a writer. The Options.Subdirs
+// walk skips watching directories containing a named pipe, but this is a
+// second line of defense in case one is watched directly.
+func TestHashFileNamedPipe(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("named pipes are created differently on Windows")
+	}
+	testdir := tempMkdir(t)
+	defer os.RemoveAll(testdir)
+
+	fifo := filepath.Join(testdir, "fifo")
+	if err := syscall.Mkfifo(fifo, 0600); err != nil {
+		t.Fatalf("Mkfifo(%s): %s", fifo, err)
+	}
+
+	done := make(chan bool, 1)
+	go func() {
+		_, ok := hashFile(Filename(fifo))
+		if ok {
+			t.Errorf("expected hashFile to refuse a named pipe")
+		}
+		done <- true
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("hashFile blocked reading a named pipe with no writer")
+	}
+}